@@ -14,9 +14,9 @@ import (
 	"io"
 	"net"
 	"net/url"
-	"strconv"
 	"time"
 
+	"github.com/agl/ed25519"
 	"github.com/syncthing/protocol"
 	"github.com/syncthing/syncthing/lib/beacon"
 	"github.com/syncthing/syncthing/lib/events"
@@ -35,6 +35,21 @@ type localClient struct {
 	localBcastTick  <-chan time.Time
 	forcedBcastTick chan time.Time
 
+	privateKey  *[ed25519.PrivateKeySize]byte
+	keyProvider DeviceKeyProvider
+	sigCache    *verifiedSigCache
+	lastSeen    map[protocol.DeviceID]time.Time
+	limiter     *announceLimiter
+
+	// LocalAnnLegacyAccept, when set, makes recvAnnouncements accept the
+	// older unsigned announcement format (AnnouncementMagicLegacy) from
+	// peers that haven't upgraded yet, unless StrictLocalAnn is also set.
+	// StrictLocalAnn, when set, drops
+	// any announcement that isn't signed, even from a device we have no
+	// pinned key for.
+	LocalAnnLegacyAccept bool
+	StrictLocalAnn       bool
+
 	*cache
 }
 
@@ -47,54 +62,43 @@ var (
 	ErrIncorrectMagic = errors.New("incorrect magic number")
 )
 
-func NewLocal(id protocol.DeviceID, addr string, addrList AddressLister, relayStat RelayStatusProvider) (FinderService, error) {
+// NewLocal returns a FinderService that announces and browses for devices
+// on the local network. addr is a URI whose scheme selects the
+// LocalTransport to carry the announcements, e.g. "bcast://:21027" or
+// "mcast://[ff12::8384]:21027"; see RegisterLocalTransport for adding
+// others.
+func NewLocal(id protocol.DeviceID, addr string, addrList AddressLister, relayStat RelayStatusProvider, privateKey *[ed25519.PrivateKeySize]byte, keyProvider DeviceKeyProvider) (FinderService, error) {
 	c := &localClient{
-		Supervisor:      suture.NewSimple("local"),
-		myID:            id,
-		addrList:        addrList,
-		relayStat:       relayStat,
-		localBcastTick:  time.Tick(BroadcastInterval),
-		forcedBcastTick: make(chan time.Time),
-		localBcastStart: time.Now(),
-		cache:           newCache(),
+		Supervisor:           suture.NewSimple("local"),
+		myID:                 id,
+		addrList:             addrList,
+		relayStat:            relayStat,
+		localBcastTick:       time.Tick(BroadcastInterval),
+		forcedBcastTick:      make(chan time.Time),
+		localBcastStart:      time.Now(),
+		privateKey:           privateKey,
+		keyProvider:          keyProvider,
+		sigCache:             newVerifiedSigCache(),
+		lastSeen:             make(map[protocol.DeviceID]time.Time),
+		limiter:              newAnnounceLimiter(),
+		LocalAnnLegacyAccept: true,
+		cache:                newCache(),
 	}
 
-	host, port, err := net.SplitHostPort(addr)
+	b, err := openTransport(addr)
 	if err != nil {
 		return nil, err
 	}
-
-	if len(host) == 0 {
-		// A broadcast client
-		c.name = "IPv4 local"
-		bcPort, err := strconv.Atoi(port)
-		if err != nil {
-			return nil, err
-		}
-		c.startLocalIPv4Broadcasts(bcPort)
-	} else {
-		// A multicast client
-		c.name = "IPv6 local"
-		c.startLocalIPv6Multicasts(addr)
-	}
+	c.name = addr
+	c.beacon = b
+	c.Add(c.beacon)
+	go c.recvAnnouncements(c.beacon)
 
 	go c.sendLocalAnnouncements()
 
 	return c, nil
 }
 
-func (c *localClient) startLocalIPv4Broadcasts(localPort int) {
-	c.beacon = beacon.NewBroadcast(localPort)
-	c.Add(c.beacon)
-	go c.recvAnnouncements(c.beacon)
-}
-
-func (c *localClient) startLocalIPv6Multicasts(localMCAddr string) {
-	c.beacon = beacon.NewMulticast(localMCAddr)
-	c.Add(c.beacon)
-	go c.recvAnnouncements(c.beacon)
-}
-
 // Lookup returns a list of addresses the device is available at. Local
 // discovery never returns relays.
 func (c *localClient) Lookup(device protocol.DeviceID) (direct []string, relays []Relay, err error) {
@@ -116,6 +120,13 @@ func (c *localClient) Error() error {
 	return c.beacon.Error()
 }
 
+// Counters returns the current rate-limit/quarantine state for every
+// source address we've heard local announcements from, for exposure over
+// the REST API.
+func (c *localClient) Counters() map[string]AnnounceSourceCounter {
+	return c.limiter.Counters()
+}
+
 func (c *localClient) announcementPkt() Announce {
 	addrs := c.addrList.AllAddresses()
 
@@ -142,10 +153,16 @@ func (c *localClient) announcementPkt() Announce {
 
 func (c *localClient) sendLocalAnnouncements() {
 	var pkt = c.announcementPkt()
-	msg := pkt.MustMarshalXDR()
 
 	for {
-		c.beacon.Send(msg)
+		signed, err := signAnnounce(pkt, c.privateKey)
+		if err != nil {
+			if debug {
+				l.Debugf("discover: Failed to sign local announcement: %v", err)
+			}
+		} else {
+			c.beacon.Send(signed.MustMarshalXDR())
+		}
 
 		select {
 		case <-c.localBcastTick:
@@ -171,6 +188,22 @@ func (c *localClient) recvAnnouncements(b beacon.Interface) {
 			l.Debugf("discover: Received local announcement from %s for %s", addr, protocol.DeviceIDFromBytes(pkt.This.ID))
 		}
 
+		var id protocol.DeviceID
+		copy(id[:], pkt.This.ID)
+		if !c.limiter.Allow(addr.String(), id) {
+			if debug {
+				l.Debugf("discover: Ignoring local announcement from quarantined/rate-limited source %s", addr)
+			}
+			continue
+		}
+
+		if err := c.checkAnnounce(pkt, addr); err != nil {
+			if debug {
+				l.Debugf("discover: Rejected local announcement from %s: %v", addr, err)
+			}
+			continue
+		}
+
 		var newDevice bool
 		if bytes.Compare(pkt.This.ID, c.myID[:]) != 0 {
 			newDevice = c.registerDevice(addr, pkt.This)
@@ -184,6 +217,57 @@ func (c *localClient) recvAnnouncements(b beacon.Interface) {
 	}
 }
 
+// checkAnnounce validates the magic, signature and freshness of pkt,
+// received from addr. It returns nil if the packet should be processed, or
+// the reason it was dropped otherwise.
+//
+// The sigCache hit below is keyed on (id, signature, addr), not just
+// (id, signature): a signature only proves the device signed that exact
+// Announce payload once, somewhere. Broadcast/multicast is visible to
+// every host on the segment, so an attacker can capture one legitimately
+// signed packet and rebroadcast the identical bytes from their own
+// machine. If the cache ignored addr, that replay would short-circuit
+// straight past verifyAnnounce's replay check and let registerDevice bind
+// the victim's device ID to the attacker's source address. Keying on addr
+// means a replay from a new source always falls through to a full
+// verifyAnnounce, whose timestamp check then rejects it.
+func (c *localClient) checkAnnounce(pkt Announce, addr net.Addr) error {
+	if pkt.Magic == AnnouncementMagicLegacy {
+		if c.LocalAnnLegacyAccept && !c.StrictLocalAnn {
+			return nil
+		}
+		return ErrUnsigned
+	}
+
+	if pkt.Magic != AnnouncementMagic {
+		return ErrIncorrectMagic
+	}
+
+	var id protocol.DeviceID
+	copy(id[:], pkt.This.ID)
+
+	if c.sigCache.Seen(id, pkt.Signature, addr.String()) {
+		return nil
+	}
+
+	pub, ok := c.keyProvider.DeviceKey(id)
+	if !ok {
+		if c.StrictLocalAnn {
+			return ErrUnknownKey
+		}
+		return nil
+	}
+
+	if err := verifyAnnounce(pkt, pub, c.lastSeen[id]); err != nil {
+		return err
+	}
+
+	c.sigCache.Add(id, pkt.Signature, addr.String())
+	c.lastSeen[id] = time.Unix(pkt.Timestamp, 0)
+
+	return nil
+}
+
 func (c *localClient) registerDevice(src net.Addr, device Device) bool {
 	var id protocol.DeviceID
 	copy(id[:], device.ID)
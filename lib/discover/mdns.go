@@ -0,0 +1,370 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package discover
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/agl/ed25519"
+	"github.com/hashicorp/mdns"
+	"github.com/syncthing/protocol"
+	"github.com/syncthing/syncthing/lib/events"
+)
+
+// mdnsServiceType is the DNS-SD service type Syncthing publishes itself
+// under, so that generic mDNS/Bonjour tooling (dns-sd, Avahi, etc.) can see
+// it alongside the custom local discovery beacon.
+const mdnsServiceType = "_syncthing._tcp"
+
+// mdnsBrowseInterval is how often we re-browse for peers. Unlike the
+// broadcast beacon, mDNS browsing is driven by the client, not by peers
+// pushing announcements at us.
+const mdnsBrowseInterval = 30 * time.Second
+
+type mdnsClient struct {
+	myID      protocol.DeviceID
+	addrList  AddressLister
+	relayStat RelayStatusProvider
+
+	privateKey  *[ed25519.PrivateKeySize]byte
+	keyProvider DeviceKeyProvider
+	sigCache    *verifiedSigCache
+	limiter     *announceLimiter
+
+	server *mdns.Server
+	stop   chan struct{}
+
+	*cache
+}
+
+// NewMDNS returns a FinderService that announces and browses for devices
+// using multicast DNS / DNS-SD (RFC 6762/6763), under the service type
+// "_syncthing._tcp.local.". This lets Syncthing devices be discovered by
+// any mDNS-aware tool, at the cost of being less compact than the XDR
+// beacon protocol used by localClient.
+//
+// Like localClient, every advertised device ID is signed with privateKey
+// and checked on receipt against keyProvider, and every source is subject
+// to the same rate limiting and quarantine as beacon-based discovery:
+// mDNS is just another wire format for the same announcement, not a
+// separate, less-trusted path.
+func NewMDNS(id protocol.DeviceID, addrList AddressLister, relayStat RelayStatusProvider, privateKey *[ed25519.PrivateKeySize]byte, keyProvider DeviceKeyProvider) (FinderService, error) {
+	c := &mdnsClient{
+		myID:        id,
+		addrList:    addrList,
+		relayStat:   relayStat,
+		privateKey:  privateKey,
+		keyProvider: keyProvider,
+		sigCache:    newVerifiedSigCache(),
+		limiter:     newAnnounceLimiter(),
+		stop:        make(chan struct{}),
+		cache:       newCache(),
+	}
+
+	if err := c.startServer(); err != nil {
+		return nil, err
+	}
+
+	go c.browse()
+
+	return c, nil
+}
+
+func (c *mdnsClient) startServer() error {
+	info := c.txtRecord()
+
+	_, port, err := c.servicePort()
+	if err != nil {
+		return err
+	}
+
+	svc, err := mdns.NewMDNSService(c.myID.String(), mdnsServiceType, "", "", port, nil, info)
+	if err != nil {
+		return err
+	}
+
+	srv, err := mdns.NewServer(&mdns.Config{Zone: svc})
+	if err != nil {
+		return err
+	}
+
+	c.server = srv
+	return nil
+}
+
+// servicePort picks the port we advertise in the mDNS SRV record. We
+// advertise the first address we have, falling back to the default sync
+// protocol port if none is configured yet.
+func (c *mdnsClient) servicePort() (string, int, error) {
+	for _, addr := range c.addrList.AllAddresses() {
+		u, err := url.Parse(addr)
+		if err != nil {
+			continue
+		}
+		_, portStr, err := net.SplitHostPort(u.Host)
+		if err != nil {
+			continue
+		}
+		port, err := strconv.Atoi(portStr)
+		if err != nil {
+			continue
+		}
+		return addr, port, nil
+	}
+	return "", 22000, nil
+}
+
+// txtRecord encodes the device ID, protocol version, our claimed
+// addresses, known relays and an Ed25519 signature over (ID, addresses,
+// relays) into TXT strings, following the usual "key=value" DNS-SD
+// convention.
+//
+// The addresses are included and signed deliberately: entry.Addr/Port in
+// an mdns.ServiceEntry come from the SRV/A/AAAA records in the response, not
+// from the UDP packet's actual source, so they're exactly as forgeable as
+// Announce.This.Addresses is on the beacon path, and get the same
+// treatment. registerEntry uses these signed addresses rather than
+// trusting entry.Addr/Port on their own.
+func (c *mdnsClient) txtRecord() []string {
+	addrs := c.addrList.AllAddresses()
+	relays := c.relayStat.Relays()
+
+	sig := ed25519.Sign(c.privateKey, mdnsSignedPayload(c.myID, addrs, relays))
+
+	txt := []string{
+		"id=" + c.myID.String(),
+		"pv=" + protocol.Version,
+		"sig=" + hex.EncodeToString(sig[:]),
+	}
+	for _, addr := range addrs {
+		txt = append(txt, "addr="+addr)
+	}
+	for _, relay := range relays {
+		txt = append(txt, "relay="+relay)
+	}
+	return txt
+}
+
+func (c *mdnsClient) browse() {
+	ticker := time.NewTicker(mdnsBrowseInterval)
+	defer ticker.Stop()
+
+	for {
+		entries := make(chan *mdns.ServiceEntry, 16)
+		go c.consume(entries)
+
+		params := &mdns.QueryParam{
+			Service: mdnsServiceType,
+			Timeout: 5 * time.Second,
+			Entries: entries,
+		}
+		mdns.Query(params)
+		close(entries)
+
+		select {
+		case <-ticker.C:
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+func (c *mdnsClient) consume(entries chan *mdns.ServiceEntry) {
+	for entry := range entries {
+		if debug {
+			l.Debugf("discover/mdns: saw entry %v TXT %v", entry.Name, entry.InfoFields)
+		}
+		c.registerEntry(entry)
+	}
+}
+
+func (c *mdnsClient) registerEntry(entry *mdns.ServiceEntry) {
+	var idStr, sigStr, addrs, relays []string
+	for _, field := range entry.InfoFields {
+		switch {
+		case len(field) > 3 && field[:3] == "id=":
+			idStr = append(idStr, field[3:])
+		case len(field) > 4 && field[:4] == "sig=":
+			sigStr = append(sigStr, field[4:])
+		case len(field) > 5 && field[:5] == "addr=":
+			addrs = append(addrs, field[5:])
+		case len(field) > 6 && field[:6] == "relay=":
+			relays = append(relays, field[6:])
+		}
+	}
+	if len(idStr) != 1 {
+		return
+	}
+
+	id, err := protocol.DeviceIDFromString(idStr[0])
+	if err != nil {
+		if debug {
+			l.Debugf("discover/mdns: bad device id %q from %s: %v", idStr[0], entry.Addr, err)
+		}
+		return
+	}
+	if id == c.myID {
+		return
+	}
+
+	srcAddr := entry.Addr.String()
+
+	if !c.limiter.Allow(srcAddr, id) {
+		if debug {
+			l.Debugf("discover/mdns: ignoring entry from quarantined/rate-limited source %s", entry.Addr)
+		}
+		return
+	}
+
+	if err := c.checkSignature(id, sigStr, addrs, relays, srcAddr); err != nil {
+		if debug {
+			l.Debugf("discover/mdns: rejected entry for %s from %s: %v", id, entry.Addr, err)
+		}
+		return
+	}
+
+	direct := c.resolveAddresses(addrs, entry.Addr, entry.Port)
+
+	var relayList []Relay
+	for _, r := range relays {
+		relayList = append(relayList, Relay{URL: r})
+	}
+
+	_, existsAlready := c.Get(id)
+
+	c.Set(id, CacheEntry{
+		Direct: direct,
+		Relays: relayList,
+		when:   time.Now(),
+		found:  true,
+	})
+
+	if !existsAlready {
+		events.Default.Log(events.DeviceDiscovered, map[string]interface{}{
+			"device": id.String(),
+			"addrs":  direct,
+			"relays": relayList,
+		})
+	}
+}
+
+// resolveAddresses turns the signed "addr=" claims from a TXT record into
+// concrete dial addresses, substituting srcIP (the address from the
+// responder's A/AAAA record) for any unspecified host, the same way local.go's registerDevice
+// does for beacon announcements. If the responder made no address claims
+// at all (an older instance of this code, predating the addr= field), we
+// fall back to the SRV-derived address, same as before this fix.
+func (c *mdnsClient) resolveAddresses(claimed []string, srcIP net.IP, srcPort int) []string {
+	var valid []string
+	for _, addr := range claimed {
+		u, err := url.Parse(addr)
+		if err != nil {
+			continue
+		}
+
+		tcpAddr, err := net.ResolveTCPAddr("tcp", u.Host)
+		if err != nil {
+			continue
+		}
+
+		if len(tcpAddr.IP) == 0 || tcpAddr.IP.IsUnspecified() {
+			u.Host = fmt.Sprintf("%s:%d", srcIP, tcpAddr.Port)
+		}
+		valid = append(valid, u.String())
+	}
+
+	if len(valid) == 0 {
+		valid = []string{fmt.Sprintf("tcp://%s:%d", srcIP, srcPort)}
+	}
+
+	return valid
+}
+
+// checkSignature verifies the "sig=" TXT field against the key pinned for
+// id, over the claimed addresses and relay list, the same trust check
+// local.go applies to beacon Announce packets: entry.Addr/Port come from
+// the SRV/A records in the response, which any responder fills in itself,
+// so the claimed addresses (and not just the device ID and relay list)
+// have to be covered by the signature too. The verified-signature cache is
+// keyed on the signature, the signed payload and srcAddr (the responder's
+// A/AAAA address, as the caller passes it), so a cache hit only skips
+// re-verifying the exact same claims; any other addresses or relays, or a
+// different srcAddr, are verified afresh.
+func (c *mdnsClient) checkSignature(id protocol.DeviceID, sigStr, addrs, relays []string, srcAddr string) error {
+	if len(sigStr) != 1 {
+		return ErrUnsigned
+	}
+
+	sigBytes, err := hex.DecodeString(sigStr[0])
+	if err != nil || len(sigBytes) != ed25519.SignatureSize {
+		return ErrBadSignature
+	}
+
+	payload := mdnsSignedPayload(id, addrs, relays)
+	cacheKey := append(append([]byte{}, sigBytes...), payload...)
+
+	if c.sigCache.Seen(id, cacheKey, srcAddr) {
+		return nil
+	}
+
+	pub, ok := c.keyProvider.DeviceKey(id)
+	if !ok {
+		return ErrUnknownKey
+	}
+
+	var sig [ed25519.SignatureSize]byte
+	copy(sig[:], sigBytes)
+
+	if !ed25519.Verify(&pub, payload, &sig) {
+		return ErrBadSignature
+	}
+
+	c.sigCache.Add(id, cacheKey, srcAddr)
+	return nil
+}
+
+// Counters returns the current rate-limit/quarantine state for every
+// source address we've heard mDNS announcements from, for exposure over
+// the REST API, the same as localClient.Counters does for the beacon path.
+func (c *mdnsClient) Counters() map[string]AnnounceSourceCounter {
+	return c.limiter.Counters()
+}
+
+// Lookup returns the addresses and relays the device last advertised, if
+// that entry is younger than CacheLifeTime.
+func (c *mdnsClient) Lookup(device protocol.DeviceID) (direct []string, relays []Relay, err error) {
+	if cache, ok := c.Get(device); ok {
+		if time.Since(cache.when) < CacheLifeTime {
+			direct = cache.Direct
+			relays = cache.Relays
+		}
+	}
+	return
+}
+
+func (c *mdnsClient) String() string {
+	return "mDNS local"
+}
+
+func (c *mdnsClient) Error() error {
+	return nil
+}
+
+func (c *mdnsClient) Serve() {
+}
+
+func (c *mdnsClient) Stop() {
+	close(c.stop)
+	if c.server != nil {
+		c.server.Shutdown()
+	}
+}
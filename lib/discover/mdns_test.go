@@ -0,0 +1,93 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package discover
+
+import (
+	"encoding/hex"
+	"net"
+	"testing"
+
+	"github.com/agl/ed25519"
+	"github.com/syncthing/protocol"
+)
+
+type fakeKeyProvider map[protocol.DeviceID][ed25519.PublicKeySize]byte
+
+func (p fakeKeyProvider) DeviceKey(id protocol.DeviceID) ([ed25519.PublicKeySize]byte, bool) {
+	key, ok := p[id]
+	return key, ok
+}
+
+func TestMdnsCheckSignatureValid(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var id protocol.DeviceID
+	id[0] = 1
+	addrs := []string{"tcp://192.0.2.1:22000"}
+	relays := []string{"relay://203.0.113.1:22067"}
+
+	sig := ed25519.Sign(priv, mdnsSignedPayload(id, addrs, relays))
+
+	c := &mdnsClient{
+		keyProvider: fakeKeyProvider{id: *pub},
+		sigCache:    newVerifiedSigCache(),
+	}
+
+	if err := c.checkSignature(id, []string{hex.EncodeToString(sig[:])}, addrs, relays, "192.0.2.1:5353"); err != nil {
+		t.Fatalf("expected valid signature to verify, got %v", err)
+	}
+}
+
+func TestMdnsCheckSignatureRejectsTamperedAddress(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var id protocol.DeviceID
+	id[0] = 1
+	addrs := []string{"tcp://192.0.2.1:22000"}
+	relays := []string{"relay://203.0.113.1:22067"}
+
+	sig := ed25519.Sign(priv, mdnsSignedPayload(id, addrs, relays))
+
+	c := &mdnsClient{
+		keyProvider: fakeKeyProvider{id: *pub},
+		sigCache:    newVerifiedSigCache(),
+	}
+
+	// An attacker answering with a captured id=/sig=/relay= triple, but
+	// pointing its own SRV/A records at a different address, must not
+	// verify: the signature has to be bound to the claimed address too.
+	tampered := []string{"tcp://203.0.113.66:22000"}
+	if err := c.checkSignature(id, []string{hex.EncodeToString(sig[:])}, tampered, relays, "203.0.113.66:5353"); err == nil {
+		t.Fatal("expected tampered address to fail verification, got nil error")
+	}
+}
+
+func TestResolveAddressesSubstitutesUnspecifiedHost(t *testing.T) {
+	c := &mdnsClient{}
+
+	direct := c.resolveAddresses([]string{"tcp://0.0.0.0:22000"}, net.ParseIP("192.0.2.1"), 22000)
+
+	if len(direct) != 1 || direct[0] != "tcp://192.0.2.1:22000" {
+		t.Fatalf("expected unspecified host to be replaced with the source address, got %v", direct)
+	}
+}
+
+func TestResolveAddressesFallsBackWithNoClaims(t *testing.T) {
+	c := &mdnsClient{}
+
+	direct := c.resolveAddresses(nil, net.ParseIP("192.0.2.1"), 22000)
+
+	if len(direct) != 1 || direct[0] != "tcp://192.0.2.1:22000" {
+		t.Fatalf("expected fallback to the SRV-derived address when there are no addr= claims, got %v", direct)
+	}
+}
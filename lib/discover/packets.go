@@ -0,0 +1,50 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package discover
+
+//go:generate -command genxdr go run ../../Godeps/_workspace/src/github.com/calmh/xdr/cmd/genxdr/main.go
+//go:generate genxdr -- -o packets_xdr.go packets.go
+
+// AnnouncementMagic identifies the wire format of an Announce packet.
+// AnnouncementMagic is the current, signed format. AnnouncementMagicLegacy
+// is the older, unsigned format that recvAnnouncements will still accept
+// when LocalAnnLegacyAccept is set and StrictLocalAnn is not, for
+// compatibility with nodes that haven't upgraded yet.
+const (
+	AnnouncementMagic       = 0x9D79BC40
+	AnnouncementMagicLegacy = 0x9D79BC39
+)
+
+// Device describes a single device in an Announce packet: its ID, the
+// addresses it can be reached at, and the relays it's known to use.
+type Device struct {
+	ID        []byte // max:32
+	Addresses []string
+	Relays    []Relay
+}
+
+// Relay describes a relay server and our last known latency to it, in
+// milliseconds.
+type Relay struct {
+	URL     string
+	Latency int32
+}
+
+// Announce is the packet broadcast or multicast on the local network (and,
+// historically, sent to the global discovery server) to advertise a
+// device's presence.
+//
+// Timestamp, Nonce and Signature are only populated (and only checked) for
+// AnnouncementMagic; a packet carrying AnnouncementMagicLegacy leaves them
+// empty, as it predates signing.
+type Announce struct {
+	Magic     uint32
+	This      Device
+	Timestamp int64
+	Nonce     []byte // max:64
+	Signature []byte // max:64, Ed25519 signature over Magic||This (ID, Addresses, Relays)||Timestamp||Nonce
+}
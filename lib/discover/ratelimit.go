@@ -0,0 +1,172 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package discover
+
+import (
+	"sync"
+	"time"
+
+	"github.com/syncthing/protocol"
+	"github.com/syncthing/syncthing/lib/events"
+)
+
+const (
+	// announceRateBurst and announceRateRefill define a token bucket per
+	// source address: a source may burst this many announcements, then
+	// is limited to one every announceRateRefill.
+	announceRateBurst  = 10
+	announceRateRefill = time.Second
+
+	// maxDeviceIDsPerMinute caps how many distinct device IDs we'll
+	// learn from a single source address within a minute, before we
+	// start suspecting it of flooding forged IDs.
+	maxDeviceIDsPerMinute = 20
+
+	// quarantineDuration is how long a source that exceeds the limits
+	// above is ignored for.
+	quarantineDuration = 5 * time.Minute
+
+	// idleEvictAfter is how long a source can go unseen before its state
+	// is dropped. Without this, a LAN attacker spoofing the UDP source
+	// address of every announcement could grow the sources map without
+	// bound, trading one unbounded-resource problem for another.
+	idleEvictAfter = 15 * time.Minute
+
+	// sweepInterval is the minimum time between idle-eviction sweeps.
+	sweepInterval = time.Minute
+)
+
+// sourceState tracks the rate-limiting and quarantine state for a single
+// announcing source address.
+type sourceState struct {
+	tokens       float64
+	lastRefill   time.Time
+	lastActivity time.Time
+	windowStart  time.Time
+	seenIDs      map[protocol.DeviceID]struct{}
+	quarantined  bool
+	quarantineAt time.Time
+}
+
+// announceLimiter rate-limits and quarantines local discovery sources that
+// send us too many announcements, or too many distinct device IDs, in a
+// short time. This protects against a hostile LAN peer flooding forged
+// device IDs to force continuous re-broadcasts or to pollute the cache.
+type announceLimiter struct {
+	mut       sync.Mutex
+	sources   map[string]*sourceState
+	lastSweep time.Time
+}
+
+func newAnnounceLimiter() *announceLimiter {
+	return &announceLimiter{
+		sources: make(map[string]*sourceState),
+	}
+}
+
+// Allow reports whether an announcement claiming to be device id from
+// source addr should be processed. If the source is over its rate or
+// distinct-ID budget it is quarantined and Allow returns false until the
+// quarantine expires.
+func (l *announceLimiter) Allow(addr string, id protocol.DeviceID) bool {
+	now := time.Now()
+
+	l.mut.Lock()
+	defer l.mut.Unlock()
+
+	l.sweepIdleLocked(now)
+
+	s, ok := l.sources[addr]
+	if !ok {
+		s = &sourceState{
+			tokens:      announceRateBurst,
+			lastRefill:  now,
+			windowStart: now,
+			seenIDs:     make(map[protocol.DeviceID]struct{}),
+		}
+		l.sources[addr] = s
+	}
+	s.lastActivity = now
+
+	if s.quarantined {
+		if now.Before(s.quarantineAt.Add(quarantineDuration)) {
+			return false
+		}
+		// Quarantine expired; give the source a clean slate.
+		s.quarantined = false
+		s.tokens = announceRateBurst
+		s.windowStart = now
+		s.seenIDs = make(map[protocol.DeviceID]struct{})
+	}
+
+	// Refill the token bucket based on elapsed time.
+	if elapsed := now.Sub(s.lastRefill); elapsed > 0 {
+		s.tokens += elapsed.Seconds() / announceRateRefill.Seconds()
+		if s.tokens > announceRateBurst {
+			s.tokens = announceRateBurst
+		}
+		s.lastRefill = now
+	}
+
+	if now.Sub(s.windowStart) > time.Minute {
+		s.windowStart = now
+		s.seenIDs = make(map[protocol.DeviceID]struct{})
+	}
+	s.seenIDs[id] = struct{}{}
+
+	if s.tokens < 1 || len(s.seenIDs) > maxDeviceIDsPerMinute {
+		s.quarantined = true
+		s.quarantineAt = now
+		events.Default.Log(events.LocalAnnounceRejected, map[string]interface{}{
+			"source": addr,
+			"reason": "rate limit exceeded",
+		})
+		return false
+	}
+
+	s.tokens--
+	return true
+}
+
+// sweepIdleLocked drops any source we haven't heard from in over
+// idleEvictAfter. It's called opportunistically from Allow, at most once
+// per sweepInterval, so it doesn't need its own goroutine/ticker.
+func (l *announceLimiter) sweepIdleLocked(now time.Time) {
+	if now.Sub(l.lastSweep) < sweepInterval {
+		return
+	}
+	l.lastSweep = now
+
+	for addr, s := range l.sources {
+		if now.Sub(s.lastActivity) > idleEvictAfter {
+			delete(l.sources, addr)
+		}
+	}
+}
+
+// Counters returns a snapshot of per-source state suitable for exposing
+// over the REST/events API, keyed by source address.
+func (l *announceLimiter) Counters() map[string]AnnounceSourceCounter {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+
+	out := make(map[string]AnnounceSourceCounter, len(l.sources))
+	for addr, s := range l.sources {
+		out[addr] = AnnounceSourceCounter{
+			DistinctDeviceIDs: len(s.seenIDs),
+			Quarantined:       s.quarantined,
+		}
+	}
+	return out
+}
+
+// AnnounceSourceCounter is the externally visible state of a single
+// announcing source, as returned by announceLimiter.Counters.
+type AnnounceSourceCounter struct {
+	DistinctDeviceIDs int  `json:"distinctDeviceIDs"`
+	Quarantined       bool `json:"quarantined"`
+}
@@ -0,0 +1,107 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package discover
+
+import (
+	"testing"
+	"time"
+
+	"github.com/syncthing/protocol"
+)
+
+func deviceID(b byte) protocol.DeviceID {
+	var id protocol.DeviceID
+	id[0] = b
+	return id
+}
+
+func TestAnnounceLimiterAllowsBurst(t *testing.T) {
+	l := newAnnounceLimiter()
+
+	for i := 0; i < announceRateBurst; i++ {
+		if !l.Allow("10.0.0.1:12345", deviceID(1)) {
+			t.Fatalf("expected announcement %d within burst to be allowed", i)
+		}
+	}
+}
+
+func TestAnnounceLimiterQuarantinesOverRate(t *testing.T) {
+	l := newAnnounceLimiter()
+
+	for i := 0; i < announceRateBurst; i++ {
+		l.Allow("10.0.0.2:12345", deviceID(1))
+	}
+
+	if l.Allow("10.0.0.2:12345", deviceID(1)) {
+		t.Fatal("expected source to be quarantined after exceeding burst")
+	}
+
+	s := l.sources["10.0.0.2:12345"]
+	if !s.quarantined {
+		t.Fatal("expected internal state to be marked quarantined")
+	}
+}
+
+func TestAnnounceLimiterQuarantinesOverDistinctIDs(t *testing.T) {
+	l := newAnnounceLimiter()
+
+	// Pre-seed a source that has already seen the maximum number of
+	// distinct IDs this minute, with plenty of rate-limit tokens left, so
+	// the next Allow call exercises the distinct-ID cap specifically
+	// rather than the token bucket.
+	seen := make(map[protocol.DeviceID]struct{}, maxDeviceIDsPerMinute)
+	for i := 0; i < maxDeviceIDsPerMinute; i++ {
+		seen[deviceID(byte(i))] = struct{}{}
+	}
+	l.sources["10.0.0.3:12345"] = &sourceState{
+		tokens:       announceRateBurst,
+		lastRefill:   time.Now(),
+		windowStart:  time.Now(),
+		seenIDs:      seen,
+		lastActivity: time.Now(),
+	}
+
+	if l.Allow("10.0.0.3:12345", deviceID(byte(maxDeviceIDsPerMinute))) {
+		t.Fatal("expected source to be quarantined after exceeding distinct device ID budget")
+	}
+}
+
+func TestAnnounceLimiterResetsAfterQuarantine(t *testing.T) {
+	l := newAnnounceLimiter()
+
+	s := &sourceState{
+		tokens:       0,
+		lastRefill:   time.Now(),
+		windowStart:  time.Now(),
+		seenIDs:      make(map[protocol.DeviceID]struct{}),
+		quarantined:  true,
+		quarantineAt: time.Now().Add(-quarantineDuration - time.Second),
+		lastActivity: time.Now(),
+	}
+	l.sources["10.0.0.4:12345"] = s
+
+	if !l.Allow("10.0.0.4:12345", deviceID(1)) {
+		t.Fatal("expected source to be allowed again once quarantine has expired")
+	}
+}
+
+func TestAnnounceLimiterEvictsIdleSources(t *testing.T) {
+	l := newAnnounceLimiter()
+
+	l.sources["10.0.0.5:12345"] = &sourceState{
+		seenIDs:      make(map[protocol.DeviceID]struct{}),
+		lastActivity: time.Now().Add(-idleEvictAfter - time.Minute),
+	}
+	// Force the next Allow call to actually run the sweep.
+	l.lastSweep = time.Now().Add(-sweepInterval - time.Second)
+
+	l.Allow("10.0.0.6:12345", deviceID(1))
+
+	if _, ok := l.sources["10.0.0.5:12345"]; ok {
+		t.Fatal("expected idle source to be evicted from the map")
+	}
+}
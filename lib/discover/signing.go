@@ -0,0 +1,213 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package discover
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/agl/ed25519"
+	"github.com/syncthing/protocol"
+)
+
+var (
+	// ErrUnsigned is returned when an announcement carries no signature and
+	// the receiver does not accept unsigned ones: a legacy-format packet
+	// with StrictLocalAnn set or LocalAnnLegacyAccept unset, or an mDNS
+	// entry without a "sig=" field.
+	ErrUnsigned = errors.New("discover: unsigned announcement rejected")
+	// ErrBadSignature is returned when the Ed25519 signature on an
+	// announcement doesn't verify against the sender's known key.
+	ErrBadSignature = errors.New("discover: announcement signature does not verify")
+	// ErrUnknownKey is returned when we have no pinned key for the
+	// announcing device, so its signature can't be checked.
+	ErrUnknownKey = errors.New("discover: no known key for announcing device")
+	// ErrReplayed is returned when the announcement's timestamp is not
+	// newer than the last one we accepted from that device.
+	ErrReplayed = errors.New("discover: stale or replayed announcement")
+)
+
+// DeviceKeyProvider supplies the Ed25519 public key a device signs its
+// local announcements with. Implementations typically pin the key to the
+// first one seen for a given device ID (trust-on-first-use), or derive it
+// from a previously exchanged certificate.
+type DeviceKeyProvider interface {
+	DeviceKey(id protocol.DeviceID) (key [ed25519.PublicKeySize]byte, ok bool)
+}
+
+// signedPayload returns the bytes that are signed/verified for pkt: every
+// field of the announcement except the signature itself. This must cover
+// This.Addresses and This.Relays, not just the device ID — otherwise a LAN
+// attacker could replay a victim's valid Magic/ID/Timestamp/Nonce/Signature
+// with substituted addresses or relays and have it verify.
+func signedPayload(pkt Announce) []byte {
+	buf := make([]byte, 0, 16+len(pkt.This.ID)+len(pkt.Nonce))
+	var tmp [4]byte
+	binary.BigEndian.PutUint32(tmp[:], pkt.Magic)
+	buf = append(buf, tmp[:]...)
+	buf = append(buf, pkt.This.ID...)
+
+	for _, addr := range pkt.This.Addresses {
+		binary.BigEndian.PutUint32(tmp[:], uint32(len(addr)))
+		buf = append(buf, tmp[:]...)
+		buf = append(buf, addr...)
+	}
+
+	for _, relay := range pkt.This.Relays {
+		binary.BigEndian.PutUint32(tmp[:], uint32(len(relay.URL)))
+		buf = append(buf, tmp[:]...)
+		buf = append(buf, relay.URL...)
+		var lat [4]byte
+		binary.BigEndian.PutUint32(lat[:], uint32(relay.Latency))
+		buf = append(buf, lat[:]...)
+	}
+
+	var ts [8]byte
+	binary.BigEndian.PutUint64(ts[:], uint64(pkt.Timestamp))
+	buf = append(buf, ts[:]...)
+	buf = append(buf, pkt.Nonce...)
+	return buf
+}
+
+// signAnnounce fills in Timestamp, Nonce and Signature on pkt using priv.
+func signAnnounce(pkt Announce, priv *[ed25519.PrivateKeySize]byte) (Announce, error) {
+	pkt.Timestamp = time.Now().Unix()
+	pkt.Nonce = make([]byte, nonceSize)
+	if _, err := rand.Read(pkt.Nonce); err != nil {
+		return pkt, err
+	}
+	sig := ed25519.Sign(priv, signedPayload(pkt))
+	pkt.Signature = sig[:]
+	return pkt, nil
+}
+
+const nonceSize = 8
+
+// verifiedSigCache remembers recently verified (device, signature, source
+// address) triples so that a peer rebroadcasting the same packet from the
+// same address doesn't cost us a fresh Ed25519 verification on every
+// receive. Entries older than a short TTL no longer count as hits; the
+// cache is bounded in size, evicting its oldest entry when full, so a flood
+// of distinct signatures can't grow it without bound.
+//
+// addr is part of the key deliberately: broadcast/multicast announcements
+// are visible to every host on the segment, so a signature alone doesn't
+// prove the packet came from its claimed device this time — only that the
+// device signed it once, somewhere. Binding the cache hit to addr as well
+// means a replay from a different source always falls through to a full
+// verifyAnnounce, whose timestamp check then rejects it.
+type verifiedSigCache struct {
+	mut     sync.Mutex
+	entries map[string]time.Time
+}
+
+const (
+	sigCacheTTL     = CacheLifeTime
+	sigCacheMaxSize = 4096
+)
+
+func newVerifiedSigCache() *verifiedSigCache {
+	return &verifiedSigCache{
+		entries: make(map[string]time.Time),
+	}
+}
+
+func (c *verifiedSigCache) key(id protocol.DeviceID, sig []byte, addr string) string {
+	h := sha256.New()
+	h.Write(id[:])
+	h.Write(sig)
+	h.Write([]byte(addr))
+	return string(h.Sum(nil))
+}
+
+// Seen returns true if this exact (device, signature, source address)
+// triple was verified recently, without needing to redo the Ed25519
+// verification.
+func (c *verifiedSigCache) Seen(id protocol.DeviceID, sig []byte, addr string) bool {
+	k := c.key(id, sig, addr)
+
+	c.mut.Lock()
+	defer c.mut.Unlock()
+
+	if t, ok := c.entries[k]; ok && time.Since(t) < sigCacheTTL {
+		return true
+	}
+	return false
+}
+
+// Add records that (device, signature, source address) has been verified.
+func (c *verifiedSigCache) Add(id protocol.DeviceID, sig []byte, addr string) {
+	k := c.key(id, sig, addr)
+
+	c.mut.Lock()
+	defer c.mut.Unlock()
+
+	if len(c.entries) >= sigCacheMaxSize {
+		c.evictOldestLocked()
+	}
+	c.entries[k] = time.Now()
+}
+
+func (c *verifiedSigCache) evictOldestLocked() {
+	var oldestKey string
+	var oldest time.Time
+	for k, t := range c.entries {
+		if oldest.IsZero() || t.Before(oldest) {
+			oldest, oldestKey = t, k
+		}
+	}
+	delete(c.entries, oldestKey)
+}
+
+// mdnsSignedPayload returns the bytes signed/verified for an mDNS TXT
+// record: the device ID, its claimed addresses and its advertised relays.
+//
+// The claimed addresses must be covered by the signature, the same as
+// Announce.This.Addresses is for the beacon path: entry.Addr/Port in an
+// mdns.ServiceEntry come from the SRV/A/AAAA records in the response
+// payload, which any responder fills in itself — they are not tied to the
+// UDP packet's actual source the way the beacon's sender address is. A
+// signature that only covered (id, relays) would let an attacker replay a
+// victim's captured id=/sig=/relay= TXT fields under its own SRV/A records
+// pointing at an arbitrary host.
+func mdnsSignedPayload(id protocol.DeviceID, addrs, relays []string) []byte {
+	buf := append([]byte{}, id[:]...)
+	for _, a := range addrs {
+		buf = append(buf, a...)
+		buf = append(buf, 0)
+	}
+	for _, r := range relays {
+		buf = append(buf, r...)
+		buf = append(buf, 0)
+	}
+	return buf
+}
+
+// verifyAnnounce checks the signature and replay state of pkt, signed by
+// the device it claims to be from. lastSeen is the timestamp of the last
+// announcement we accepted from that device, if any.
+func verifyAnnounce(pkt Announce, pub [ed25519.PublicKeySize]byte, lastSeen time.Time) error {
+	if pkt.Timestamp <= lastSeen.Unix() && !lastSeen.IsZero() {
+		return ErrReplayed
+	}
+
+	var sig [ed25519.SignatureSize]byte
+	if len(pkt.Signature) != len(sig) {
+		return ErrBadSignature
+	}
+	copy(sig[:], pkt.Signature)
+
+	if !ed25519.Verify(&pub, signedPayload(pkt), &sig) {
+		return ErrBadSignature
+	}
+
+	return nil
+}
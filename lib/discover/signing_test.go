@@ -0,0 +1,112 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package discover
+
+import (
+	"testing"
+	"time"
+
+	"github.com/agl/ed25519"
+	"github.com/syncthing/protocol"
+)
+
+func TestVerifyAnnounceValidSignature(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pkt := Announce{
+		Magic: AnnouncementMagic,
+		This: Device{
+			ID:        []byte("device-id"),
+			Addresses: []string{"tcp://192.0.2.1:22000"},
+		},
+	}
+
+	signed, err := signAnnounce(pkt, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := verifyAnnounce(signed, *pub, time.Time{}); err != nil {
+		t.Fatalf("expected valid signature to verify, got %v", err)
+	}
+}
+
+func TestVerifyAnnounceRejectsTamperedAddresses(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pkt := Announce{
+		Magic: AnnouncementMagic,
+		This: Device{
+			ID:        []byte("device-id"),
+			Addresses: []string{"tcp://192.0.2.1:22000"},
+		},
+	}
+
+	signed, err := signAnnounce(pkt, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An attacker who observed the signed packet on the wire replays it
+	// with substituted addresses, keeping Magic/ID/Timestamp/Nonce/
+	// Signature unchanged. This must not verify.
+	tampered := signed
+	tampered.This.Addresses = []string{"tcp://203.0.113.66:22000"}
+
+	if err := verifyAnnounce(tampered, *pub, time.Time{}); err == nil {
+		t.Fatal("expected tampered addresses to fail verification, got nil error")
+	}
+}
+
+func TestVerifyAnnounceRejectsReplay(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pkt := Announce{
+		Magic: AnnouncementMagic,
+		This:  Device{ID: []byte("device-id")},
+	}
+
+	signed, err := signAnnounce(pkt, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lastSeen := time.Unix(signed.Timestamp, 0)
+	if err := verifyAnnounce(signed, *pub, lastSeen); err != ErrReplayed {
+		t.Fatalf("expected ErrReplayed for a non-newer timestamp, got %v", err)
+	}
+}
+
+func TestVerifiedSigCacheDoesNotCrossAddresses(t *testing.T) {
+	c := newVerifiedSigCache()
+	var id protocol.DeviceID
+	sig := []byte("some-signature-bytes")
+
+	c.Add(id, sig, "10.0.0.1:22000")
+
+	if !c.Seen(id, sig, "10.0.0.1:22000") {
+		t.Fatal("expected a hit for the address the signature was recorded against")
+	}
+
+	// A replay of the identical (id, sig) from a different source address
+	// — e.g. an attacker rebroadcasting a captured packet from their own
+	// machine — must not hit the cache, or it would bypass verifyAnnounce
+	// entirely and let registerDevice bind the victim's ID to the
+	// attacker's address.
+	if c.Seen(id, sig, "10.0.0.2:22000") {
+		t.Fatal("expected no hit for a different source address")
+	}
+}
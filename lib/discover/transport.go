@@ -0,0 +1,111 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package discover
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/syncthing/syncthing/lib/beacon"
+)
+
+// LocalTransport opens a beacon.Interface for local discovery, given the
+// parsed URI a user configured (e.g. "bcast://:21027",
+// "mcast://[ff12::8384]:21027"). It mirrors the database/sql driver
+// pattern: third parties can register their own transport under a scheme
+// of their choosing, without needing to modify localClient.
+type LocalTransport func(uri *url.URL) (beacon.Interface, error)
+
+var (
+	transportsMut sync.Mutex
+	transports    = make(map[string]LocalTransport)
+)
+
+// RegisterLocalTransport makes a LocalTransport available under the given
+// URI scheme. It panics if a transport is already registered under that
+// scheme, analogous to sql.Register.
+func RegisterLocalTransport(scheme string, transport LocalTransport) {
+	transportsMut.Lock()
+	defer transportsMut.Unlock()
+
+	if _, dup := transports[scheme]; dup {
+		panic("discover: RegisterLocalTransport called twice for scheme " + scheme)
+	}
+	transports[scheme] = transport
+}
+
+// openTransport parses addr as a URI and dispatches to the LocalTransport
+// registered for its scheme. For compatibility with configs saved before
+// transports were pluggable, it also accepts the old schemeless
+// "host:port" addresses ("" host meaning IPv4 broadcast, anything else
+// meaning IPv6 multicast) and maps them onto bcast/mcast.
+func openTransport(addr string) (beacon.Interface, error) {
+	if legacy, ok := legacyTransportURI(addr); ok {
+		addr = legacy
+	}
+
+	uri, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	transportsMut.Lock()
+	transport, ok := transports[uri.Scheme]
+	transportsMut.Unlock()
+
+	if !ok {
+		return nil, fmt.Errorf("discover: no local transport registered for scheme %q", uri.Scheme)
+	}
+
+	return transport(uri)
+}
+
+// legacyTransportURI recognizes the pre-registry "host:port" address
+// format and rewrites it as a "bcast://" or "mcast://" URI. It returns ok
+// == false for anything that already looks like a URI (has a scheme), so
+// new-style addresses are left untouched.
+func legacyTransportURI(addr string) (string, bool) {
+	if strings.Contains(addr, "://") {
+		// Already a URI with a scheme; nothing to translate.
+		return "", false
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", false
+	}
+
+	if host == "" {
+		return "bcast://:" + port, true
+	}
+	return "mcast://" + net.JoinHostPort(host, port), true
+}
+
+func init() {
+	RegisterLocalTransport("bcast", bcastTransport)
+	RegisterLocalTransport("mcast", mcastTransport)
+}
+
+// bcastTransport implements the original IPv4 broadcast beacon, addressed
+// as "bcast://:<port>".
+func bcastTransport(uri *url.URL) (beacon.Interface, error) {
+	port, err := strconv.Atoi(uri.Port())
+	if err != nil {
+		return nil, fmt.Errorf("discover: bcast transport: %v", err)
+	}
+	return beacon.NewBroadcast(port), nil
+}
+
+// mcastTransport implements the original IPv6 multicast beacon, addressed
+// as "mcast://[ff12::8384]:<port>".
+func mcastTransport(uri *url.URL) (beacon.Interface, error) {
+	return beacon.NewMulticast(uri.Host), nil
+}
@@ -0,0 +1,50 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package discover
+
+import "testing"
+
+func TestLegacyTransportURI(t *testing.T) {
+	cases := []struct {
+		addr   string
+		want   string
+		wantOk bool
+	}{
+		{":21027", "bcast://:21027", true},
+		{"[ff12::8384]:21027", "mcast://[ff12::8384]:21027", true},
+		{"bcast://:21027", "", false},
+		{"mcast://[ff12::8384]:21027", "", false},
+		{"not a host port", "", false},
+	}
+
+	for _, tc := range cases {
+		got, ok := legacyTransportURI(tc.addr)
+		if ok != tc.wantOk {
+			t.Errorf("legacyTransportURI(%q) ok = %v, want %v", tc.addr, ok, tc.wantOk)
+			continue
+		}
+		if ok && got != tc.want {
+			t.Errorf("legacyTransportURI(%q) = %q, want %q", tc.addr, got, tc.want)
+		}
+	}
+}
+
+func TestOpenTransportLegacyAddresses(t *testing.T) {
+	if _, err := openTransport(":21027"); err != nil {
+		t.Errorf("expected legacy broadcast address to resolve to the bcast transport, got %v", err)
+	}
+
+	if _, err := openTransport("[ff12::8384]:21027"); err != nil {
+		t.Errorf("expected legacy multicast address to resolve to the mcast transport, got %v", err)
+	}
+}
+
+func TestOpenTransportUnknownScheme(t *testing.T) {
+	if _, err := openTransport("quic://:21027"); err == nil {
+		t.Fatal("expected an error for a scheme with no registered transport")
+	}
+}
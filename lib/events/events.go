@@ -0,0 +1,67 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package events provides a mechanism for observing events occurring
+// elsewhere in the application, for example to power the REST /events API.
+package events
+
+import (
+	"sync"
+	"time"
+)
+
+// EventType identifies a kind of event.
+type EventType int
+
+const (
+	DeviceDiscovered EventType = 1 << iota
+	LocalAnnounceRejected
+)
+
+// Event is a single occurrence logged through a Logger, with the data
+// describing it.
+type Event struct {
+	Time time.Time
+	Type EventType
+	Data interface{}
+}
+
+// Logger receives and buffers events for later retrieval, e.g. by the
+// REST /events API.
+type Logger struct {
+	mut    sync.Mutex
+	events []Event
+	max    int
+}
+
+// NewLogger returns a Logger retaining at most max recent events.
+func NewLogger(max int) *Logger {
+	return &Logger{max: max}
+}
+
+// Log records an event of the given type.
+func (l *Logger) Log(t EventType, data interface{}) {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+
+	l.events = append(l.events, Event{Time: time.Now(), Type: t, Data: data})
+	if len(l.events) > l.max {
+		l.events = l.events[len(l.events)-l.max:]
+	}
+}
+
+// All returns the events currently buffered, oldest first.
+func (l *Logger) All() []Event {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+
+	out := make([]Event, len(l.events))
+	copy(out, l.events)
+	return out
+}
+
+// Default is the global event logger used throughout the application.
+var Default = NewLogger(1000)